@@ -0,0 +1,551 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Retry is a middleware that retries requests.
+type Retry struct {
+	attempts      int
+	next          http.Handler
+	listener      RetryListener
+	backoff       Backoff
+	checkRetry    CheckRetry
+	maxBodyMemory int64
+	maxBodyDisk   int64
+}
+
+// RetryOption configures a Retry middleware. Options are applied in the
+// order they are given to NewRetry.
+type RetryOption func(*Retry)
+
+// WithBackoff sets the Backoff strategy used to compute the delay between
+// attempts. Without this option, Retry defaults to DefaultBackoff; pass a
+// ConstantBackoff with a zero Delay to restore the historical behavior of
+// retrying immediately.
+func WithBackoff(backoff Backoff) RetryOption {
+	return func(retry *Retry) {
+		retry.backoff = backoff
+	}
+}
+
+// WithCheckRetry sets the policy used to decide, after each attempt,
+// whether Retry should try again. Without this option, Retry uses
+// DefaultCheckRetry.
+func WithCheckRetry(checkRetry CheckRetry) RetryOption {
+	return func(retry *Retry) {
+		retry.checkRetry = checkRetry
+	}
+}
+
+// WithMaxBodySize sets the thresholds used to buffer a POST/PUT/PATCH
+// request body so it can be replayed, unmodified, on every retry attempt:
+// up to maxMemory bytes are kept in memory, up to maxDisk bytes are
+// spilled to a temp file, and anything larger is passed through verbatim
+// as a single, non-retryable attempt. Without this option, Retry uses
+// defaultMaxRetryBodyMemory and defaultMaxRetryBodyDisk.
+func WithMaxBodySize(maxMemory, maxDisk int64) RetryOption {
+	return func(retry *Retry) {
+		retry.maxBodyMemory = maxMemory
+		retry.maxBodyDisk = maxDisk
+	}
+}
+
+// NewRetry returns a new Retry instance.
+func NewRetry(attempts int, next http.Handler, listener RetryListener, opts ...RetryOption) *Retry {
+	retry := &Retry{
+		attempts:      attempts,
+		next:          next,
+		listener:      listener,
+		backoff:       DefaultBackoff(),
+		checkRetry:    DefaultCheckRetry,
+		maxBodyMemory: defaultMaxRetryBodyMemory,
+		maxBodyDisk:   defaultMaxRetryBodyDisk,
+	}
+	for _, opt := range opts {
+		opt(retry)
+	}
+	return retry
+}
+
+// errNetError is passed to CheckRetry in place of the real network error,
+// which ServeHTTP never sees directly: it only learns of it through the
+// NetErrorRecorder callback.
+var errNetError = errors.New("network error")
+
+func (retry *Retry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if retry.attempts <= 1 {
+		stashAttempts(req, 1)
+		retry.next.ServeHTTP(rw, req)
+		return
+	}
+
+	getBody, retryable, cleanup, err := prepareRetryBody(req, retry.maxBodyMemory, retry.maxBodyDisk)
+	if cleanup != nil {
+		defer cleanup()
+	}
+	if err != nil {
+		// The body couldn't be captured safely: fall back to a single,
+		// non-retrying attempt using req.Body exactly as it is now (note
+		// prepareRetryBody may have already consumed part of it).
+		stashAttempts(req, 1)
+		retry.next.ServeHTTP(rw, req)
+		return
+	}
+	if !retryable {
+		// The body is too large to buffer: getBody reconstructs the
+		// original, uninterrupted stream for a single, non-retrying
+		// attempt.
+		if body, bodyErr := getBody(); bodyErr == nil {
+			req.Body = body
+		}
+		stashAttempts(req, 1)
+		retry.next.ServeHTTP(rw, req)
+		return
+	}
+
+	// Each attempt's body (an in-memory reader, a freshly opened file, or,
+	// for a method whose body isn't buffered, the original body itself)
+	// is ours to close once it's no longer needed; closePrevBody releases
+	// the one still in req.Body before getBody's next result takes its
+	// place, or when we return for good. An unbuffered original body is
+	// therefore already read and closed when a later attempt gets it.
+	var prevBody io.ReadCloser
+	closePrevBody := func() {
+		if prevBody != nil {
+			prevBody.Close()
+		}
+	}
+	defer closePrevBody()
+
+	attempts := 1
+	for {
+		// The invariant here is that Body, Content-Length and GetBody
+		// are reset to the full, original request before every attempt,
+		// including the first.
+		body, bodyErr := getBody()
+		if bodyErr == nil {
+			closePrevBody()
+			req.Body = body
+			req.GetBody = getBody
+			prevBody = body
+		}
+
+		attemptStart := time.Now()
+		netErrorOccurred := false
+		recorder := newRetryResponseRecorder(rw)
+
+		newCtx := context.WithValue(req.Context(), defaultNetErrCtxKey, &netErrorOccurred)
+		retry.next.ServeHTTP(recorder, req.WithContext(newCtx))
+
+		var attemptErr error
+		var resp *http.Response
+		if netErrorOccurred {
+			attemptErr = errNetError
+		} else {
+			resp = recorder.toResponse()
+		}
+
+		shouldRetry, permanentErr := retry.checkRetry(req.Context(), resp, attemptErr)
+
+		if recorder.alreadyStreamed() || permanentErr != nil || !shouldRetry || attempts >= retry.attempts {
+			stashAttempts(req, attempts)
+			recorder.flushToWriter(rw)
+			return
+		}
+
+		delay := time.Duration(0)
+		if retryAfter, ok := retryAfterDelay(resp, time.Now()); ok {
+			delay = retryAfter
+		} else if retry.backoff != nil {
+			delay = retry.backoff.Next(attempts, req, resp)
+		}
+
+		event := RetryEvent{
+			Attempt:     attempts + 1,
+			Elapsed:     time.Since(attemptStart),
+			LastErr:     attemptErr,
+			NextBackoff: delay,
+		}
+		if resp != nil {
+			event.LastStatus = resp.StatusCode
+		}
+		notifyRetryListener(retry.listener, req, event)
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+				stashAttempts(req, attempts)
+				recorder.flushToWriter(rw)
+				return
+			}
+		}
+
+		attempts++
+	}
+}
+
+// stashAttempts mutates req in place so that, once ServeHTTP returns, any
+// code still holding that same *http.Request (e.g. an outer access log or
+// tracing middleware) can read the total number of attempts Retry made.
+func stashAttempts(req *http.Request, attempts int) {
+	*req = *req.WithContext(context.WithValue(req.Context(), retryAttemptsCtxKey, attempts))
+}
+
+// AttemptsFromContext returns the number of attempts Retry made while
+// serving the request whose context is ctx, and whether Retry took part
+// in serving it at all. It is 1 for a request that succeeded (or ran out
+// of retries) without ever being retried.
+func AttemptsFromContext(ctx context.Context) (int, bool) {
+	attempts, ok := ctx.Value(retryAttemptsCtxKey).(int)
+	return attempts, ok
+}
+
+// notifyRetryListener calls the richer RetriedWithEvent when listener
+// implements EventRetryListener, falling back to the legacy
+// Retried(req, attempt) otherwise.
+func notifyRetryListener(listener RetryListener, req *http.Request, event RetryEvent) {
+	if eventListener, ok := listener.(EventRetryListener); ok {
+		eventListener.RetriedWithEvent(req, event)
+		return
+	}
+	listener.Retried(req, event.Attempt)
+}
+
+// CheckRetry decides, after an attempt has completed, whether Retry should
+// try again. resp is nil when the attempt failed with a network error
+// (reported through NetErrorRecorder), in which case err is errNetError.
+// Returning a non-nil error is a permanent failure: it aborts all further
+// attempts regardless of the returned bool, and the buffered response (or
+// the one that triggered the error) is sent to the client as-is.
+type CheckRetry func(ctx context.Context, resp *http.Response, err error) (bool, error)
+
+// DefaultRetryableStatusCodes is the set of response status codes that
+// DefaultCheckRetry retries in addition to recorded network errors.
+var DefaultRetryableStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// DefaultCheckRetry retries recorded network errors and the status codes
+// in DefaultRetryableStatusCodes.
+var DefaultCheckRetry = NewCheckRetry(nil, nil)
+
+// NewCheckRetry builds a CheckRetry policy from the DefaultRetryableStatusCodes
+// set, adjusted by retryableStatusCodes (added to the set) and
+// nonRetryableStatusCodes (removed from the set, taking precedence over
+// retryableStatusCodes).
+func NewCheckRetry(retryableStatusCodes, nonRetryableStatusCodes []int) CheckRetry {
+	retryable := make(map[int]bool)
+	for _, code := range DefaultRetryableStatusCodes {
+		retryable[code] = true
+	}
+	for _, code := range retryableStatusCodes {
+		retryable[code] = true
+	}
+	nonRetryable := make(map[int]bool)
+	for _, code := range nonRetryableStatusCodes {
+		nonRetryable[code] = true
+	}
+
+	return func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		if err != nil {
+			return true, nil
+		}
+		if resp == nil {
+			return false, nil
+		}
+		if nonRetryable[resp.StatusCode] {
+			return false, nil
+		}
+		return retryable[resp.StatusCode], nil
+	}
+}
+
+// retryAfterDelay reports the delay requested by a Retry-After response
+// header, if any. Retry-After is either a number of seconds or an
+// HTTP-date; when present it takes precedence over the configured Backoff
+// for that one attempt.
+func retryAfterDelay(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			seconds = 0
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// Backoff computes the delay to wait before a given retry attempt. attempt
+// is 1-based: attempt 1 is the delay before the first retry (i.e. after the
+// first failed try). resp may be nil when the previous attempt failed with a
+// network error rather than a response.
+type Backoff interface {
+	Next(attempt int, req *http.Request, resp *http.Response) time.Duration
+}
+
+// ConstantBackoff waits the same Delay before every retry.
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+// Next implements Backoff.
+func (b ConstantBackoff) Next(attempt int, req *http.Request, resp *http.Response) time.Duration {
+	return b.Delay
+}
+
+// ExponentialJitterBackoff waits min(Max, Min*Factor^attempt). When Jitter
+// is set, that delay is then full-jittered, i.e. replaced with a value
+// drawn uniformly from [delay/2, delay], to spread out retries from a
+// thundering herd of clients without ever exceeding Max.
+type ExponentialJitterBackoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Factor float64
+	Jitter bool
+}
+
+// Next implements Backoff.
+func (b ExponentialJitterBackoff) Next(attempt int, req *http.Request, resp *http.Response) time.Duration {
+	factor := b.Factor
+	if factor <= 0 {
+		factor = 2
+	}
+
+	delay := float64(b.Min) * math.Pow(factor, float64(attempt))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	if !b.Jitter {
+		return time.Duration(delay)
+	}
+
+	half := delay / 2
+	return time.Duration(half + rand.Float64()*half)
+}
+
+// DefaultBackoff returns the ExponentialJitterBackoff used when retry is
+// enabled in the static configuration but no backoff settings were
+// provided.
+func DefaultBackoff() Backoff {
+	return ExponentialJitterBackoff{
+		Min:    500 * time.Millisecond,
+		Max:    4 * time.Second,
+		Factor: 2,
+		Jitter: true,
+	}
+}
+
+// RetryListener is used to inform about retry attempts.
+type RetryListener interface {
+	// Retried is called when a retry happens, with the request attempt
+	// passed to it. For the first retry, this will be attempt 2.
+	Retried(req *http.Request, attempt int)
+}
+
+// RetryEvent describes the attempt that just completed and the retry
+// decision computed from it.
+type RetryEvent struct {
+	// Attempt is the attempt about to be made, matching the attempt
+	// argument of the legacy Retried(req, attempt). For the first retry,
+	// this is 2.
+	Attempt int
+	// Elapsed is how long the attempt that just completed took.
+	Elapsed time.Duration
+	// LastStatus is the status code returned by the attempt that just
+	// completed, or 0 if it failed with a network error.
+	LastStatus int
+	// LastErr is the error recorded for the attempt that just completed
+	// (via NetErrorRecorder), or nil if it completed with a response.
+	LastErr error
+	// NextBackoff is the delay Retry will wait before making Attempt.
+	NextBackoff time.Duration
+}
+
+// EventRetryListener is the richer counterpart of RetryListener: Retry
+// calls RetriedWithEvent on listeners that implement it instead of the
+// legacy Retried, passing the full RetryEvent rather than just the
+// attempt number.
+type EventRetryListener interface {
+	RetriedWithEvent(req *http.Request, event RetryEvent)
+}
+
+// RetryListeners is a list of RetryListener that calls each listener in turn.
+type RetryListeners []RetryListener
+
+// Retried exists to implement the RetryListener interface.
+func (l RetryListeners) Retried(req *http.Request, attempt int) {
+	for _, listener := range l {
+		listener.Retried(req, attempt)
+	}
+}
+
+type key string
+
+const defaultNetErrCtxKey key = "NetErrCtxKey"
+
+// retryAttemptsCtxKey is the well-known context key under which Retry
+// stores the total number of attempts made for a request. See
+// AttemptsFromContext.
+const retryAttemptsCtxKey key = "RetryAttempts"
+
+// NetErrorRecorder is an interface to record net errors.
+type NetErrorRecorder interface {
+	// Record records the occurrence of a network error.
+	Record(ctx context.Context)
+}
+
+// DefaultNetErrorRecorder is the default NetErrorRecorder implementation.
+type DefaultNetErrorRecorder struct{}
+
+// Record records the occurrence of a network error by setting the value
+// of the defaultNetErrCtxKey key in the request's context to true.
+func (DefaultNetErrorRecorder) Record(ctx context.Context) {
+	if netErrorOccurred, ok := ctx.Value(defaultNetErrCtxKey).(*bool); ok {
+		*netErrorOccurred = true
+	}
+}
+
+// responseRecorder buffers a response so it can be discarded, or replayed
+// to the real http.ResponseWriter, once the retry decision is final.
+type responseRecorder interface {
+	http.ResponseWriter
+	http.Flusher
+	getCode() int
+	flushToWriter(rw http.ResponseWriter)
+	toResponse() *http.Response
+	alreadyStreamed() bool
+}
+
+type headerResponseWriter struct {
+	HeaderMap http.Header
+	Code      int
+	Body      *bytes.Buffer
+	streamed  bool
+}
+
+func (r *headerResponseWriter) Header() http.Header {
+	if r.HeaderMap == nil {
+		r.HeaderMap = make(http.Header)
+	}
+	return r.HeaderMap
+}
+
+func (r *headerResponseWriter) Write(buf []byte) (int, error) {
+	return r.Body.Write(buf)
+}
+
+func (r *headerResponseWriter) WriteHeader(code int) {
+	r.Code = code
+}
+
+func (r *headerResponseWriter) getCode() int {
+	if r.Code == 0 {
+		return http.StatusOK
+	}
+	return r.Code
+}
+
+// flushToWriter replays whatever has been buffered so far to rw and
+// resets the buffer, so it can be called more than once (e.g. once from
+// Flush, and once more when the retry decision becomes final).
+func (r *headerResponseWriter) flushToWriter(rw http.ResponseWriter) {
+	for k, v := range r.HeaderMap {
+		rw.Header()[k] = v
+	}
+	rw.WriteHeader(r.getCode())
+	if r.Body.Len() > 0 {
+		rw.Write(r.Body.Bytes())
+		r.Body.Reset()
+	}
+}
+
+// toResponse builds an *http.Response snapshot of what has been buffered so
+// far, for CheckRetry to inspect. It does not consume or reset the buffer.
+func (r *headerResponseWriter) toResponse() *http.Response {
+	return &http.Response{
+		StatusCode:    r.getCode(),
+		Header:        r.HeaderMap,
+		Body:          ioutil.NopCloser(bytes.NewReader(r.Body.Bytes())),
+		ContentLength: int64(r.Body.Len()),
+	}
+}
+
+func (r *headerResponseWriter) alreadyStreamed() bool {
+	return r.streamed
+}
+
+type retryResponseRecorderWithoutCloseNotify struct {
+	*headerResponseWriter
+	rw http.ResponseWriter
+}
+
+func (r *retryResponseRecorderWithoutCloseNotify) Flush() {
+	r.streamed = true
+	r.flushToWriter(r.rw)
+	if flusher, ok := r.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type retryResponseRecorderWithCloseNotify struct {
+	*retryResponseRecorderWithoutCloseNotify
+}
+
+// CloseNotify exists to implement the http.CloseNotifier interface.
+func (r *retryResponseRecorderWithCloseNotify) CloseNotify() <-chan bool {
+	return r.rw.(http.CloseNotifier).CloseNotify()
+}
+
+// newRetryResponseRecorder returns a responseRecorder wrapping rw. If rw
+// implements http.CloseNotifier, the returned recorder does too, so that
+// handlers relying on connection-close notifications keep working while
+// their response is buffered.
+func newRetryResponseRecorder(rw http.ResponseWriter) responseRecorder {
+	base := &retryResponseRecorderWithoutCloseNotify{
+		headerResponseWriter: &headerResponseWriter{
+			HeaderMap: make(http.Header),
+			Body:      new(bytes.Buffer),
+		},
+		rw: rw,
+	}
+
+	if _, ok := rw.(http.CloseNotifier); ok {
+		return &retryResponseRecorderWithCloseNotify{base}
+	}
+	return base
+}
@@ -0,0 +1,139 @@
+package middlewares
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+const (
+	// defaultMaxRetryBodyMemory is the default size, in bytes, up to which
+	// a retryable request body is buffered in memory.
+	defaultMaxRetryBodyMemory = 1 << 20 // 1 MiB
+	// defaultMaxRetryBodyDisk is the default size, in bytes, up to which a
+	// request body that outgrew memory is spilled to a temp file. Past
+	// this, the request is treated as non-retryable.
+	defaultMaxRetryBodyDisk = 10 << 20 // 10 MiB
+)
+
+// retryableBodyMethods lists the request methods whose body Retry buffers
+// for replay. GET/HEAD bodies are left untouched: they are rare, and
+// reading them here would consume a stream the rest of the chain may not
+// expect to be read twice.
+var retryableBodyMethods = map[string]bool{
+	http.MethodPost:  true,
+	http.MethodPut:   true,
+	http.MethodPatch: true,
+}
+
+// prepareRetryBody buffers req's body so it can be replayed, unmodified,
+// before every retry attempt. It returns a GetBody-style func, whether the
+// request may be retried, and a cleanup func that must be called once the
+// request has finished (it removes any spilled temp file).
+//
+// Bodies up to maxMemory are kept in memory; bodies up to maxDisk are
+// spilled to a temp file; bodies larger than maxDisk are left as a single,
+// non-retryable pass-through of the original stream. A body sent with a
+// method that isn't in retryableBodyMethods is not captured at all: the
+// request is still reported as retryable, and getBody returns that same
+// original body on every call.
+func prepareRetryBody(req *http.Request, maxMemory, maxDisk int64) (getBody func() (io.ReadCloser, error), retryable bool, cleanup func(), err error) {
+	noop := func() {}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return func() (io.ReadCloser, error) { return http.NoBody, nil }, true, noop, nil
+	}
+
+	if !retryableBodyMethods[req.Method] {
+		// Retry doesn't buffer bodies for this method: hand the original
+		// body straight back instead of capturing (and so consuming) it,
+		// so a non-POST/PUT/PATCH request with a real body (e.g. a GET
+		// some APIs use with one) reaches the handler unmodified.
+		body := req.Body
+		return func() (io.ReadCloser, error) { return body, nil }, true, noop, nil
+	}
+
+	var memory bytes.Buffer
+	read, err := io.CopyN(&memory, req.Body, maxMemory+1)
+	if err != nil && err != io.EOF {
+		return nil, false, noop, err
+	}
+
+	if read <= maxMemory {
+		data := memory.Bytes()
+		return func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}, true, noop, nil
+	}
+
+	// The body didn't fit in memory: spill it, and whatever comes next,
+	// to a temp file up to maxDisk.
+	tmp, err := ioutil.TempFile("", "traefik-retry-body-")
+	if err != nil {
+		return nil, false, noop, err
+	}
+	cleanup = func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	if _, err := tmp.Write(memory.Bytes()); err != nil {
+		cleanup()
+		return nil, false, noop, err
+	}
+
+	spilled, err := io.CopyN(tmp, req.Body, maxDisk-read+1)
+	if err != nil && err != io.EOF {
+		cleanup()
+		return nil, false, noop, err
+	}
+
+	if read+spilled > maxDisk {
+		// Past the hard limit: give up on retrying and hand back a
+		// single reader that reconstructs the original, uninterrupted
+		// stream from what was already consumed plus what's left.
+		reopen := &reopenReader{path: tmp.Name()}
+		body := struct {
+			io.Reader
+			io.Closer
+		}{
+			Reader: io.MultiReader(reopen, req.Body),
+			Closer: reopen,
+		}
+		return func() (io.ReadCloser, error) { return body, nil }, false, cleanup, nil
+	}
+
+	path := tmp.Name()
+	tmp.Close()
+	return func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}, true, cleanup, nil
+}
+
+// reopenReader lazily opens path on first Read, so callers can build it
+// into an io.MultiReader without holding the file open up front. Close
+// releases the file descriptor, if one was opened.
+type reopenReader struct {
+	path string
+	file *os.File
+}
+
+func (r *reopenReader) Read(p []byte) (int, error) {
+	if r.file == nil {
+		f, err := os.Open(r.path)
+		if err != nil {
+			return 0, err
+		}
+		r.file = f
+	}
+	return r.file.Read(p)
+}
+
+func (r *reopenReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
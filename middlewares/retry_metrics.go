@@ -0,0 +1,86 @@
+package middlewares
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusRetryListener is an EventRetryListener that records retry
+// attempts as Prometheus metrics: traefik_backend_retries_total, a
+// counter partitioned by backend and the status code (or "network_error")
+// that triggered the retry, and traefik_backend_retry_backoff_seconds, a
+// histogram of the computed backoff delays.
+type PrometheusRetryListener struct {
+	backend string
+	retries *prometheus.CounterVec
+	backoff prometheus.Histogram
+}
+
+// NewPrometheusRetryListener registers traefik_backend_retries_total and
+// traefik_backend_retry_backoff_seconds with registerer, reusing them if
+// they were already registered (e.g. by a listener for another backend),
+// and returns a listener that records samples under them for backend.
+func NewPrometheusRetryListener(registerer prometheus.Registerer, backend string) (*PrometheusRetryListener, error) {
+	retries, err := registerOrReuseCounterVec(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "traefik_backend_retries_total",
+		Help: "Number of retries per backend and response status code",
+	}, []string{"backend", "code"}))
+	if err != nil {
+		return nil, err
+	}
+
+	backoff, err := registerOrReuseHistogram(registerer, prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "traefik_backend_retry_backoff_seconds",
+		Help:    "Backoff delay observed before a retry, in seconds",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	return &PrometheusRetryListener{backend: backend, retries: retries, backoff: backoff}, nil
+}
+
+// Retried exists to implement RetryListener, so a PrometheusRetryListener
+// can be passed directly to NewRetry. Retry prefers RetriedWithEvent when
+// it is available, so this is only reached when it isn't.
+func (l *PrometheusRetryListener) Retried(req *http.Request, attempt int) {
+	l.RetriedWithEvent(req, RetryEvent{Attempt: attempt})
+}
+
+// RetriedWithEvent implements EventRetryListener.
+func (l *PrometheusRetryListener) RetriedWithEvent(req *http.Request, event RetryEvent) {
+	code := "network_error"
+	if event.LastErr == nil {
+		code = strconv.Itoa(event.LastStatus)
+	}
+
+	l.retries.WithLabelValues(l.backend, code).Inc()
+	l.backoff.Observe(event.NextBackoff.Seconds())
+}
+
+func registerOrReuseCounterVec(registerer prometheus.Registerer, vec *prometheus.CounterVec) (*prometheus.CounterVec, error) {
+	if err := registerer.Register(vec); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			if existing, ok := are.ExistingCollector.(*prometheus.CounterVec); ok {
+				return existing, nil
+			}
+		}
+		return nil, err
+	}
+	return vec, nil
+}
+
+func registerOrReuseHistogram(registerer prometheus.Registerer, histogram prometheus.Histogram) (prometheus.Histogram, error) {
+	if err := registerer.Register(histogram); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			if existing, ok := are.ExistingCollector.(prometheus.Histogram); ok {
+				return existing, nil
+			}
+		}
+		return nil, err
+	}
+	return histogram, nil
+}
@@ -1,13 +1,19 @@
 package middlewares
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -202,3 +208,355 @@ func (m *mockRWCloseNotify) Write([]byte) (int, error) {
 func (m *mockRWCloseNotify) WriteHeader(int) {
 	panic("implement me")
 }
+
+func TestExponentialJitterBackoffNeverExceedsMax(t *testing.T) {
+	backoff := ExponentialJitterBackoff{Min: 10 * time.Millisecond, Max: 100 * time.Millisecond, Factor: 2, Jitter: true}
+
+	for attempt := 1; attempt <= 20; attempt++ {
+		delay := backoff.Next(attempt, httptest.NewRequest(http.MethodGet, "/", nil), nil)
+		if delay > backoff.Max {
+			t.Fatalf("attempt %d: delay %s exceeds Max %s", attempt, delay, backoff.Max)
+		}
+
+		// Once the uncapped exponential value has grown past Max, the
+		// jittered result must still land in the full-jitter range
+		// [Max/2, Max].
+		if attempt >= 5 && delay < backoff.Max/2 {
+			t.Fatalf("attempt %d: delay %s is below the jittered floor %s", attempt, delay, backoff.Max/2)
+		}
+	}
+}
+
+func TestRetryCancelledDuringBackoffSleep(t *testing.T) {
+	httpHandler := &networkFailingHTTPHandler{failAtCalls: []int{1, 2, 3}, netErrorRecorder: &DefaultNetErrorRecorder{}}
+	retry := NewRetry(3, httpHandler, &countingRetryListener{}, WithBackoff(ConstantBackoff{Delay: time.Hour}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		recorder := httptest.NewRecorder()
+		retry.ServeHTTP(recorder, req)
+		close(done)
+	}()
+
+	// Give the handler time to fail once and enter the backoff sleep
+	// before cancelling, so we actually exercise the context.Done() path.
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ServeHTTP did not return after the request context was cancelled")
+	}
+}
+
+func TestDefaultCheckRetryRetriesOnStatusCode(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		status   int
+		expected bool
+	}{
+		{desc: "429 is retried", status: http.StatusTooManyRequests, expected: true},
+		{desc: "502 is retried", status: http.StatusBadGateway, expected: true},
+		{desc: "503 is retried", status: http.StatusServiceUnavailable, expected: true},
+		{desc: "404 is not retried", status: http.StatusNotFound, expected: false},
+		{desc: "200 is not retried", status: http.StatusOK, expected: false},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			retry, err := DefaultCheckRetry(context.Background(), &http.Response{StatusCode: test.status}, nil)
+			if err != nil {
+				t.Fatalf("unexpected permanent error: %v", err)
+			}
+			if retry != test.expected {
+				t.Errorf("got retry=%v for status %d, want %v", retry, test.status, test.expected)
+			}
+		})
+	}
+}
+
+func TestNewCheckRetryHonorsConfiguredStatusCodes(t *testing.T) {
+	checkRetry := NewCheckRetry([]int{http.StatusNotFound}, []int{http.StatusBadGateway})
+
+	retry, _ := checkRetry(context.Background(), &http.Response{StatusCode: http.StatusNotFound}, nil)
+	if !retry {
+		t.Error("404 should be retried once added to retryableStatusCodes")
+	}
+
+	retry, _ = checkRetry(context.Background(), &http.Response{StatusCode: http.StatusBadGateway}, nil)
+	if retry {
+		t.Error("502 should not be retried once added to nonRetryableStatusCodes")
+	}
+}
+
+func TestRetryHonorsRetryAfterOverBackoff(t *testing.T) {
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Retry-After", "0")
+		rw.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	retry := NewRetry(2, handler, &countingRetryListener{}, WithBackoff(ConstantBackoff{Delay: time.Hour}))
+
+	done := make(chan struct{})
+	go func() {
+		retry.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ServeHTTP did not return promptly; Retry-After: 0 should have pre-empted the configured backoff")
+	}
+}
+
+func TestRetryAbortsOnPermanentCheckRetryError(t *testing.T) {
+	errPermanent := fmt.Errorf("permanent failure")
+	listener := &countingRetryListener{}
+
+	retry := NewRetry(3, &networkFailingHTTPHandler{failAtCalls: []int{1, 2}, netErrorRecorder: &DefaultNetErrorRecorder{}}, listener,
+		WithCheckRetry(func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+			return false, errPermanent
+		}))
+
+	recorder := httptest.NewRecorder()
+	retry.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("got status %d, want %d", recorder.Code, http.StatusBadGateway)
+	}
+	if listener.timesCalled != 0 {
+		t.Errorf("listener called %d times, want 0: a permanent CheckRetry error must abort before any retry", listener.timesCalled)
+	}
+}
+
+// bodyObservingHandler records the full body it received on every call, and
+// fails the first failAtCalls-1 attempts so Retry is forced to replay it.
+type bodyObservingHandler struct {
+	failAtCalls int
+	callNumber  int
+	bodies      [][]byte
+}
+
+func (h *bodyObservingHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.callNumber++
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.bodies = append(h.bodies, body)
+
+	if h.callNumber < h.failAtCalls {
+		DefaultNetErrorRecorder{}.Record(req.Context())
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func TestRetryReplaysFullBodyOnEveryAttempt(t *testing.T) {
+	payload := make([]byte, 2<<20) // 2 MiB, spills past the default in-memory threshold
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("could not generate payload: %v", err)
+	}
+
+	handler := &bodyObservingHandler{failAtCalls: 3}
+	retry := NewRetry(3, handler, &countingRetryListener{})
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+	recorder := httptest.NewRecorder()
+	retry.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if len(handler.bodies) != 3 {
+		t.Fatalf("handler was called %d times, want 3", len(handler.bodies))
+	}
+	for i, body := range handler.bodies {
+		if !bytes.Equal(body, payload) {
+			t.Errorf("attempt %d: body did not match the original %d-byte payload (got %d bytes)", i+1, len(payload), len(body))
+		}
+	}
+}
+
+func TestAttemptsFromContextPopulatedEvenWithoutRetries(t *testing.T) {
+	httpHandler := &networkFailingHTTPHandler{netErrorRecorder: &DefaultNetErrorRecorder{}}
+	retry := NewRetry(3, httpHandler, &countingRetryListener{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	retry.ServeHTTP(httptest.NewRecorder(), req)
+
+	attempts, ok := AttemptsFromContext(req.Context())
+	if !ok {
+		t.Fatal("expected AttemptsFromContext to report Retry took part in serving the request")
+	}
+	if attempts != 1 {
+		t.Errorf("got Attempts=%d, want 1 for a request that succeeded on the first try", attempts)
+	}
+}
+
+func TestAttemptsFromContextReflectsRetries(t *testing.T) {
+	httpHandler := &networkFailingHTTPHandler{failAtCalls: []int{1, 2}, netErrorRecorder: &DefaultNetErrorRecorder{}}
+	retry := NewRetry(3, httpHandler, &countingRetryListener{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	retry.ServeHTTP(httptest.NewRecorder(), req)
+
+	attempts, ok := AttemptsFromContext(req.Context())
+	if !ok || attempts != 3 {
+		t.Errorf("got Attempts=%d, ok=%v, want Attempts=3, ok=true", attempts, ok)
+	}
+}
+
+// eventCountingRetryListener implements EventRetryListener to verify Retry
+// prefers it over the legacy Retried when both are available.
+type eventCountingRetryListener struct {
+	events []RetryEvent
+}
+
+func (l *eventCountingRetryListener) Retried(req *http.Request, attempt int) {
+	l.events = append(l.events, RetryEvent{Attempt: attempt})
+}
+
+func (l *eventCountingRetryListener) RetriedWithEvent(req *http.Request, event RetryEvent) {
+	l.events = append(l.events, event)
+}
+
+func TestRetryPrefersEventRetryListener(t *testing.T) {
+	httpHandler := &networkFailingHTTPHandler{failAtCalls: []int{1, 2}, netErrorRecorder: &DefaultNetErrorRecorder{}}
+	listener := &eventCountingRetryListener{}
+	retry := NewRetry(3, httpHandler, listener)
+
+	retry.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if len(listener.events) != 2 {
+		t.Fatalf("got %d events, want 2", len(listener.events))
+	}
+	for i, event := range listener.events {
+		if event.LastErr != errNetError {
+			t.Errorf("event %d: got LastErr=%v, want errNetError", i, event.LastErr)
+		}
+	}
+	if listener.events[0].Attempt != 2 || listener.events[1].Attempt != 3 {
+		t.Errorf("got attempts %d, %d, want 2, 3", listener.events[0].Attempt, listener.events[1].Attempt)
+	}
+}
+
+func TestPrometheusRetryListenerRecordsOneSamplePerRetry(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	listener, err := NewPrometheusRetryListener(registry, "backend-a")
+	if err != nil {
+		t.Fatalf("could not create listener: %v", err)
+	}
+
+	httpHandler := &networkFailingHTTPHandler{failAtCalls: []int{1, 2}, netErrorRecorder: &DefaultNetErrorRecorder{}}
+	retry := NewRetry(3, httpHandler, listener)
+	retry.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	metricFamilies, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("could not gather metrics: %v", err)
+	}
+
+	var total float64
+	for _, family := range metricFamilies {
+		if family.GetName() != "traefik_backend_retries_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			total += metric.GetCounter().GetValue()
+		}
+	}
+
+	if total != 2 {
+		t.Errorf("got %v retries recorded, want 2 (one per retry, not per request)", total)
+	}
+}
+
+// erroringBody fails on its first Read with a non-EOF error, simulating a
+// client that disconnects mid-upload.
+type erroringBody struct{}
+
+func (erroringBody) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+func (erroringBody) Close() error             { return nil }
+
+func TestRetryDoesNotPanicWhenBodyReadFails(t *testing.T) {
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	retry := NewRetry(3, handler, &countingRetryListener{})
+
+	req := httptest.NewRequest(http.MethodPost, "/", erroringBody{})
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("ServeHTTP panicked on a failing request body: %v", r)
+		}
+	}()
+
+	recorder := httptest.NewRecorder()
+	retry.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", recorder.Code, http.StatusOK)
+	}
+}
+
+func TestRetryDoesNotStripBodyFromNonBufferedMethods(t *testing.T) {
+	const payload = "a body on a method Retry doesn't buffer"
+
+	var gotBody string
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf("could not read request body: %v", err)
+		}
+		gotBody = string(body)
+		rw.WriteHeader(http.StatusOK)
+	})
+	retry := NewRetry(3, handler, &countingRetryListener{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", bytes.NewBufferString(payload))
+	retry.ServeHTTP(httptest.NewRecorder(), req)
+
+	if gotBody != payload {
+		t.Errorf("got body %q, want %q", gotBody, payload)
+	}
+}
+
+func TestNewRetryDefaultsToNonZeroBackoff(t *testing.T) {
+	httpHandler := &networkFailingHTTPHandler{failAtCalls: []int{1}, netErrorRecorder: &DefaultNetErrorRecorder{}}
+	listener := &eventCountingRetryListener{}
+	retry := NewRetry(2, httpHandler, listener)
+
+	retry.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if len(listener.events) != 1 {
+		t.Fatalf("got %d events, want 1", len(listener.events))
+	}
+	if listener.events[0].NextBackoff <= 0 {
+		t.Errorf("got NextBackoff=%s with no WithBackoff option, want a positive delay from DefaultBackoff", listener.events[0].NextBackoff)
+	}
+}
+
+func TestExponentialJitterBackoffWithoutJitterIsDeterministic(t *testing.T) {
+	backoff := ExponentialJitterBackoff{Min: 10 * time.Millisecond, Max: 100 * time.Millisecond, Factor: 2}
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		want := time.Duration(float64(backoff.Min) * math.Pow(backoff.Factor, float64(attempt)))
+		got := backoff.Next(attempt, httptest.NewRequest(http.MethodGet, "/", nil), nil)
+		if got != want {
+			t.Errorf("attempt %d: got delay %s, want exact (unjittered) delay %s", attempt, got, want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package types
+
+import "time"
+
+// Retry holds the static configuration for the retry middleware, which
+// reissues a request to the backend a limited number of times when the
+// previous attempt failed.
+type Retry struct {
+	// Attempts is the maximum number of times a request is attempted.
+	Attempts int `description:"Number of attempts" export:"true"`
+	// InitialInterval is the delay before the first retry. A zero value
+	// means no backoff is configured, in which case the default
+	// exponential backoff (middlewares.DefaultBackoff) is used.
+	InitialInterval time.Duration `description:"Initial interval of the exponential backoff" export:"true"`
+	// MaxInterval caps the delay computed for any given attempt. A zero
+	// value means no cap is applied.
+	MaxInterval time.Duration `description:"Maximum interval of the exponential backoff" export:"true"`
+	// Multiplier is the factor the interval is multiplied by after every
+	// attempt. Traefik defaults this to 2 when InitialInterval is set but
+	// Multiplier is left at its zero value.
+	Multiplier float64 `description:"Multiplier applied to the interval after each attempt" export:"true"`
+	// Jitter enables full jitter on the computed backoff interval, so
+	// that concurrent clients retrying the same backend don't all wake up
+	// at the same time.
+	Jitter bool `description:"Apply a random jitter to the computed backoff interval" export:"true"`
+	// RetryableStatusCodes adds status codes to the default set (429 and
+	// the common 5xx codes) that are retried.
+	RetryableStatusCodes []int `description:"Additional response status codes that should be retried" export:"true"`
+	// NonRetryableStatusCodes removes status codes from the retryable
+	// set, taking precedence over RetryableStatusCodes.
+	NonRetryableStatusCodes []int `description:"Response status codes that must never be retried" export:"true"`
+	// MaxBodySize is the maximum size, in bytes, of a POST/PUT/PATCH
+	// request body kept in memory so it can be replayed on retry. Larger
+	// bodies are spilled to disk up to MaxBodySizeOnDisk.
+	MaxBodySize int64 `description:"Maximum size, in bytes, of a request body buffered in memory for retries" export:"true"`
+	// MaxBodySizeOnDisk is the hard cap, in bytes, on a request body
+	// spilled to disk for retries. Bodies larger than this are sent
+	// through verbatim as a single, non-retryable attempt.
+	MaxBodySizeOnDisk int64 `description:"Maximum size, in bytes, of a request body spilled to disk for retries" export:"true"`
+}